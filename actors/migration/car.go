@@ -0,0 +1,101 @@
+package migration
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	car "github.com/ipfs/go-car"
+	carutil "github.com/ipfs/go-car/util"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	carv2 "github.com/ipld/go-car/v2"
+	"golang.org/x/xerrors"
+)
+
+// blockRecorder accumulates the blocks written to a store during a migration, in write order, so
+// they can be exported as a CAR afterwards without a second pass over the output tree. Writes are
+// append-only and de-duplicated by CID: a migrator may Put the same unchanged sub-structure from
+// more than one actor (e.g. a shared empty HAMT), and it should appear in the export exactly once.
+type blockRecorder struct {
+	mu    sync.Mutex
+	order []cid.Cid
+	data  map[cid.Cid][]byte
+}
+
+func newBlockRecorder() *blockRecorder {
+	return &blockRecorder{data: map[cid.Cid][]byte{}}
+}
+
+func (r *blockRecorder) record(c cid.Cid, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.data[c]; found {
+		return
+	}
+	r.data[c] = data
+	r.order = append(r.order, c)
+}
+
+// recordingStore wraps a cbor.IpldStore, additionally recording every block it writes so the
+// newly-written portion of a migrated state tree can be exported as a standalone CAR.
+type recordingStore struct {
+	cbor.IpldStore
+	recorder *blockRecorder
+}
+
+// WrapExportStore wraps store so every block written through it is recorded for CAR export, if
+// cfg.ExportCAR is set; otherwise it returns store unchanged. It is idempotent: calling it again on
+// a store it has already wrapped returns that same store rather than double-wrapping.
+//
+// Callers that construct an output state tree of their own (rather than relying on MigrateState's
+// generic OutputTree) must call this and use the returned store for that tree too, before passing
+// it to MigrateStateTree: the tree's own Flush writes its internal nodes, including the block for
+// the declared root CID, and those would otherwise never reach blockRecorder even though
+// MigrateStateTree wraps its own copy of store internally.
+func WrapExportStore(store cbor.IpldStore, cfg Config) cbor.IpldStore {
+	if cfg.ExportCAR == nil {
+		return store
+	}
+	if _, ok := store.(recordingStore); ok {
+		return store
+	}
+	return recordingStore{IpldStore: store, recorder: newBlockRecorder()}
+}
+
+func (s recordingStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	raw, err := cbor.DumpObject(v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err := s.IpldStore.Put(ctx, v)
+	if err != nil {
+		return cid.Undef, err
+	}
+	s.recorder.record(c, raw)
+	return c, nil
+}
+
+// writeCAR streams every block recorded by r into a CARv2 file at root, for independent
+// verification of a migration's output: an operator can replay the export against the migration's
+// known root and confirm the resulting state root hashes match, without access to the full input
+// state tree.
+func writeCAR(w io.Writer, root cid.Cid, r *blockRecorder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var v1 bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, &v1); err != nil {
+		return xerrors.Errorf("failed to write CAR header: %w", err)
+	}
+	for _, c := range r.order {
+		if err := carutil.LdWrite(&v1, c.Bytes(), r.data[c]); err != nil {
+			return xerrors.Errorf("failed to write CAR block %s: %w", c, err)
+		}
+	}
+	if err := carv2.WrapV1(bytes.NewReader(v1.Bytes()), w); err != nil {
+		return xerrors.Errorf("failed to wrap migration export as CARv2: %w", err)
+	}
+	return nil
+}
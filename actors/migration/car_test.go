@@ -0,0 +1,66 @@
+package migration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWriteCARIncludesDeclaredRoot guards against a CAR export whose header root points at a
+// block the export itself never wrote: that CAR cannot even be opened at its own root, let alone
+// independently replayed and hashed against the canonical migration output.
+func TestWriteCARIncludesDeclaredRoot(t *testing.T) {
+	ctx := context.Background()
+	base := cbor.NewMemCborStore()
+	recorder := newBlockRecorder()
+	store := recordingStore{IpldStore: base, recorder: recorder}
+
+	leafCID, err := store.Put(ctx, "leaf")
+	require.NoError(t, err)
+	rootCID, err := store.Put(ctx, []cid.Cid{leafCID})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, writeCAR(&out, rootCID, recorder))
+
+	reader, err := carv2.NewBlockReader(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{rootCID}, reader.Roots)
+
+	seen := map[cid.Cid]bool{}
+	for {
+		blk, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		seen[blk.Cid()] = true
+	}
+	require.True(t, seen[rootCID], "exported CAR must contain the block for its own declared root")
+	require.True(t, seen[leafCID], "exported CAR must contain blocks reachable from the root")
+}
+
+// TestWrapExportStoreIdempotent guards against double-wrapping: a caller that constructs an
+// output state tree against an already-wrapped store, then passes that same store into
+// MigrateStateTree, must not end up with two independent recorders (which would split the
+// exported blocks across two CARs, neither complete).
+func TestWrapExportStoreIdempotent(t *testing.T) {
+	base := cbor.NewMemCborStore()
+	cfg := Config{ExportCAR: &bytes.Buffer{}}
+
+	wrapped := WrapExportStore(base, cfg)
+	rs, ok := wrapped.(recordingStore)
+	require.True(t, ok)
+
+	wrappedAgain := WrapExportStore(wrapped, cfg)
+	rsAgain, ok := wrappedAgain.(recordingStore)
+	require.True(t, ok)
+	require.Same(t, rs.recorder, rsAgain.recorder)
+}
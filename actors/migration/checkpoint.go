@@ -0,0 +1,116 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+)
+
+// bitmap is a growable set of non-negative integers, used to track which actors (by their
+// position in the deterministic iteration order of an InputTree) a migration run has already
+// completed.
+type bitmap []byte
+
+func (b *bitmap) Set(i int) {
+	byteIdx, bit := i/8, uint(i%8)
+	if byteIdx >= len(*b) {
+		grown := make(bitmap, byteIdx+1)
+		copy(grown, *b)
+		*b = grown
+	}
+	(*b)[byteIdx] |= 1 << bit
+}
+
+func (b bitmap) Has(i int) bool {
+	byteIdx, bit := i/8, uint(i%8)
+	if byteIdx >= len(b) {
+		return false
+	}
+	return b[byteIdx]&(1<<bit) != 0
+}
+
+func (b bitmap) Clone() bitmap {
+	out := make(bitmap, len(b))
+	copy(out, b)
+	return out
+}
+
+// checkpointState is what loadCheckpoint recovers from CachedMigration: the completed-address
+// bitmap, and (for the caller's benefit, since this package does not construct output trees) the
+// partial output root it was checkpointed alongside.
+type checkpointState struct {
+	bitmap bitmap
+	root   cid.Cid
+}
+
+func checkpointBitmapKey(priorEpoch abi.ChainEpoch) string {
+	return fmt.Sprintf("migration-checkpoint-bitmap-%d", priorEpoch)
+}
+
+func checkpointRootKey(priorEpoch abi.ChainEpoch) string {
+	return fmt.Sprintf("migration-checkpoint-root-%d", priorEpoch)
+}
+
+func loadCheckpoint(ctx context.Context, store cbor.IpldStore, cfg Config, priorEpoch abi.ChainEpoch) (checkpointState, error) {
+	if cfg.CachedMigration == nil {
+		return checkpointState{}, nil
+	}
+	bitmapCID, found, err := cfg.CachedMigration.Load(checkpointBitmapKey(priorEpoch))
+	if err != nil {
+		return checkpointState{}, xerrors.Errorf("failed to load migration checkpoint bitmap: %w", err)
+	}
+	if !found {
+		return checkpointState{}, nil
+	}
+	rootCID, found, err := cfg.CachedMigration.Load(checkpointRootKey(priorEpoch))
+	if err != nil {
+		return checkpointState{}, xerrors.Errorf("failed to load migration checkpoint root: %w", err)
+	}
+	if !found {
+		return checkpointState{}, nil
+	}
+	var bits []byte
+	if err := store.Get(ctx, bitmapCID, &bits); err != nil {
+		return checkpointState{}, xerrors.Errorf("failed to load migration checkpoint bitmap block: %w", err)
+	}
+	return checkpointState{bitmap: bits, root: rootCID}, nil
+}
+
+// storeCheckpoint flushes the output tree's current (partial) state and records it, alongside the
+// given completed-address bitmap, in cfg.CachedMigration so a subsequent run can resume from here
+// via loadCheckpoint.
+func storeCheckpoint(ctx context.Context, store cbor.IpldStore, cfg Config, priorEpoch abi.ChainEpoch, actorsOut OutputTree, completed bitmap) error {
+	root, err := actorsOut.Flush()
+	if err != nil {
+		return xerrors.Errorf("failed to flush partial state tree for checkpoint: %w", err)
+	}
+	bitmapCID, err := store.Put(ctx, ([]byte)(completed))
+	if err != nil {
+		return xerrors.Errorf("failed to store checkpoint bitmap: %w", err)
+	}
+	if err := cfg.CachedMigration.Store(checkpointRootKey(priorEpoch), root); err != nil {
+		return xerrors.Errorf("failed to store checkpoint root: %w", err)
+	}
+	if err := cfg.CachedMigration.Store(checkpointBitmapKey(priorEpoch), bitmapCID); err != nil {
+		return xerrors.Errorf("failed to store checkpoint bitmap CID: %w", err)
+	}
+	return nil
+}
+
+// CheckpointRoot returns the partial output tree root recorded by the most recent checkpoint for
+// priorEpoch, if any, so a caller can load it (instead of starting from an empty tree) before
+// resuming a migration with MigrateStateTree.
+func CheckpointRoot(ctx context.Context, store cbor.IpldStore, cfg Config, priorEpoch abi.ChainEpoch) (cid.Cid, bool, error) {
+	checkpoint, err := loadCheckpoint(ctx, store, cfg, priorEpoch)
+	if err != nil {
+		return cid.Undef, false, err
+	}
+	if checkpoint.root == cid.Undef {
+		return cid.Undef, false, nil
+	}
+	return checkpoint.root, true, nil
+}
@@ -0,0 +1,80 @@
+package migration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	big "github.com/filecoin-project/go-state-types/big"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointRootNoCachedMigration(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+
+	_, found, err := CheckpointRoot(ctx, store, Config{}, abi.ChainEpoch(0))
+	require.NoError(t, err)
+	require.False(t, found, "no CachedMigration configured means no checkpoint to resume from")
+}
+
+func TestCheckpointRootNothingStoredYet(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+	cfg := Config{CachedMigration: newMemMigrationCache()}
+
+	_, found, err := CheckpointRoot(ctx, store, cfg, abi.ChainEpoch(0))
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+// TestStoreAndLoadCheckpointRoundTrip exercises the full checkpoint/resume cycle a long-running
+// migration relies on: storeCheckpoint flushes and records a partial output root and a
+// completed-address bitmap, and a subsequent run recovers both via loadCheckpoint/CheckpointRoot.
+func TestStoreAndLoadCheckpointRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+	cfg := Config{CachedMigration: newMemMigrationCache()}
+	epoch := abi.ChainEpoch(7)
+
+	outTree := newFakeOutputTree(store)
+	addr := newTestAddress(t, 700)
+	head := mustCborCid(t, store, "checkpoint-head")
+	require.NoError(t, outTree.SetActor(addr, &Actor{Code: head, Head: head, Balance: big.Zero()}))
+
+	var completed bitmap
+	completed.Set(3)
+	completed.Set(10)
+
+	require.NoError(t, storeCheckpoint(ctx, store, cfg, epoch, outTree, completed))
+
+	wantRoot, err := outTree.Flush()
+	require.NoError(t, err)
+
+	root, found, err := CheckpointRoot(ctx, store, cfg, epoch)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, wantRoot, root)
+
+	checkpoint, err := loadCheckpoint(ctx, store, cfg, epoch)
+	require.NoError(t, err)
+	require.True(t, checkpoint.bitmap.Has(3))
+	require.True(t, checkpoint.bitmap.Has(10))
+	require.False(t, checkpoint.bitmap.Has(4))
+}
+
+// TestCheckpointRootKeyedByPriorEpoch guards against one epoch's checkpoint being mistaken for
+// another's: distinct priorEpoch values must not collide in CachedMigration's key space.
+func TestCheckpointRootKeyedByPriorEpoch(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+	cfg := Config{CachedMigration: newMemMigrationCache()}
+
+	outTree := newFakeOutputTree(store)
+	require.NoError(t, storeCheckpoint(ctx, store, cfg, abi.ChainEpoch(1), outTree, bitmap{}))
+
+	_, found, err := CheckpointRoot(ctx, store, cfg, abi.ChainEpoch(2))
+	require.NoError(t, err)
+	require.False(t, found, "a checkpoint stored for one priorEpoch must not be visible under another")
+}
@@ -0,0 +1,41 @@
+package migration
+
+import "sync"
+
+// MigrationContext is a concurrent-safe, in-memory publish/subscribe bus shared by every
+// migrator invoked during a single MigrateStateTree run. It lets a migrator publish a value
+// under a topic and key during one phase, and a later migrator in another phase (typically a
+// Deferred() one, once every other actor has been migrated) subscribe to read it. This is what
+// lets a deferred migration depend on values accumulated through the migration of other actors.
+type MigrationContext struct {
+	mu  sync.RWMutex
+	bus map[string]map[interface{}]interface{}
+}
+
+func NewMigrationContext() *MigrationContext {
+	return &MigrationContext{bus: map[string]map[interface{}]interface{}{}}
+}
+
+// Publish records value under key within topic, overwriting any value already published there.
+func (c *MigrationContext) Publish(topic string, key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, ok := c.bus[topic]
+	if !ok {
+		entries = map[interface{}]interface{}{}
+		c.bus[topic] = entries
+	}
+	entries[key] = value
+}
+
+// Subscribe retrieves the value published under key within topic, if any.
+func (c *MigrationContext) Subscribe(topic string, key interface{}) (value interface{}, found bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries, ok := c.bus[topic]
+	if !ok {
+		return nil, false
+	}
+	value, found = entries[key]
+	return value, found
+}
@@ -0,0 +1,109 @@
+package nv9
+
+import (
+	"bytes"
+	"context"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	market2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/market"
+
+	builtin3 "github.com/filecoin-project/specs-actors/v3/actors/builtin"
+	market3 "github.com/filecoin-project/specs-actors/v3/actors/builtin/market"
+
+	"github.com/filecoin-project/specs-actors/v3/actors/migration"
+)
+
+// marketMigrator migrates a single market actor's state from its v2 to its v3 shape. Its Proposals
+// and States AMTs hold one entry per deal ever made on the network and can be as large as a
+// miner's Sectors AMT, so both are migrated with ParallelArrayMigrate.
+type marketMigrator struct {
+	cfg migration.Config
+}
+
+func (m marketMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in StateMigrationInput) (*StateMigrationResult, error) {
+	var inState market2.State
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
+		return nil, xerrors.Errorf("failed to load market state for %s: %w", in.Address, err)
+	}
+
+	newProposals, err := ParallelArrayMigrate(ctx, store, inState.Proposals, market3.ProposalsAmtBitwidth, m.cfg, migrateDealProposal)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to migrate deal proposals for %s: %w", in.Address, err)
+	}
+	newStates, err := ParallelArrayMigrate(ctx, store, inState.States, market3.StatesAmtBitwidth, m.cfg, migrateDealState)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to migrate deal states for %s: %w", in.Address, err)
+	}
+
+	outState := market3.State{
+		Proposals:                     newProposals,
+		States:                        newStates,
+		PendingProposals:              inState.PendingProposals,
+		EscrowTable:                   inState.EscrowTable,
+		LockedTable:                   inState.LockedTable,
+		NextID:                        inState.NextID,
+		DealOpsByEpoch:                inState.DealOpsByEpoch,
+		LastCron:                      inState.LastCron,
+		TotalClientLockedCollateral:   inState.TotalClientLockedCollateral,
+		TotalProviderLockedCollateral: inState.TotalProviderLockedCollateral,
+		TotalClientStorageFee:         inState.TotalClientStorageFee,
+	}
+	newHead, err := store.Put(ctx, &outState)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to store migrated market state for %s: %w", in.Address, err)
+	}
+	return &StateMigrationResult{
+		NewCodeCID: builtin3.StorageMarketActorCodeID,
+		NewHead:    newHead,
+	}, nil
+}
+
+// migrateDealProposal migrates a single entry of a market actor's Proposals AMT. The v2 and v3
+// shapes of DealProposal are identical field-for-field; this exists so the copy runs through
+// ParallelArrayMigrate's worker pool instead of serially.
+func migrateDealProposal(_ context.Context, _ cbor.IpldStore, _ uint64, value *cbg.Deferred) (*cbg.Deferred, bool, error) {
+	var in market2.DealProposal
+	if err := in.UnmarshalCBOR(bytes.NewReader(value.Raw)); err != nil {
+		return nil, false, xerrors.Errorf("failed to unmarshal deal proposal: %w", err)
+	}
+	out := market3.DealProposal{
+		PieceCID:             in.PieceCID,
+		PieceSize:            in.PieceSize,
+		VerifiedDeal:         in.VerifiedDeal,
+		Client:               in.Client,
+		Provider:             in.Provider,
+		Label:                in.Label,
+		StartEpoch:           in.StartEpoch,
+		EndEpoch:             in.EndEpoch,
+		StoragePricePerEpoch: in.StoragePricePerEpoch,
+		ProviderCollateral:   in.ProviderCollateral,
+		ClientCollateral:     in.ClientCollateral,
+	}
+	var buf bytes.Buffer
+	if err := out.MarshalCBOR(&buf); err != nil {
+		return nil, false, xerrors.Errorf("failed to marshal deal proposal: %w", err)
+	}
+	return &cbg.Deferred{Raw: buf.Bytes()}, true, nil
+}
+
+// migrateDealState migrates a single entry of a market actor's States AMT, analogous to
+// migrateDealProposal.
+func migrateDealState(_ context.Context, _ cbor.IpldStore, _ uint64, value *cbg.Deferred) (*cbg.Deferred, bool, error) {
+	var in market2.DealState
+	if err := in.UnmarshalCBOR(bytes.NewReader(value.Raw)); err != nil {
+		return nil, false, xerrors.Errorf("failed to unmarshal deal state: %w", err)
+	}
+	out := market3.DealState{
+		SectorStartEpoch: in.SectorStartEpoch,
+		LastUpdatedEpoch: in.LastUpdatedEpoch,
+		SlashEpoch:       in.SlashEpoch,
+	}
+	var buf bytes.Buffer
+	if err := out.MarshalCBOR(&buf); err != nil {
+		return nil, false, xerrors.Errorf("failed to marshal deal state: %w", err)
+	}
+	return &cbg.Deferred{Raw: buf.Bytes()}, true, nil
+}
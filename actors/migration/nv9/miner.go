@@ -0,0 +1,92 @@
+package nv9
+
+import (
+	"bytes"
+	"context"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	miner2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/miner"
+
+	builtin3 "github.com/filecoin-project/specs-actors/v3/actors/builtin"
+	miner3 "github.com/filecoin-project/specs-actors/v3/actors/builtin/miner"
+
+	"github.com/filecoin-project/specs-actors/v3/actors/migration"
+)
+
+// minerMigrator migrates a single miner actor's state from its v2 to its v3 shape. A miner's
+// Sectors AMT is the one part of its state that can run to gigabytes on mainnet, so it is migrated
+// with ParallelArrayMigrate rather than serially on the worker goroutine handling the rest of this
+// (comparatively tiny) actor.
+type minerMigrator struct {
+	cfg migration.Config
+}
+
+func (m minerMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in StateMigrationInput) (*StateMigrationResult, error) {
+	var inState miner2.State
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
+		return nil, xerrors.Errorf("failed to load miner state for %s: %w", in.Address, err)
+	}
+
+	newSectors, err := ParallelArrayMigrate(ctx, store, inState.Sectors, miner3.SectorsAmtBitwidth, m.cfg, migrateSectorInfo)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to migrate sectors for %s: %w", in.Address, err)
+	}
+
+	outState := miner3.State{
+		Info:                      inState.Info,
+		PreCommitDeposits:         inState.PreCommitDeposits,
+		LockedFunds:               inState.LockedFunds,
+		VestingFunds:              inState.VestingFunds,
+		InitialPledge:             inState.InitialPledge,
+		PreCommittedSectors:       inState.PreCommittedSectors,
+		PreCommittedSectorsExpiry: inState.PreCommittedSectorsExpiry,
+		AllocatedSectors:          inState.AllocatedSectors,
+		Sectors:                   newSectors,
+		ProvingPeriodStart:        inState.ProvingPeriodStart,
+		CurrentDeadline:           inState.CurrentDeadline,
+		Deadlines:                 inState.Deadlines,
+		EarlyTerminations:         inState.EarlyTerminations,
+		DeadlineCronActive:        inState.DeadlineCronActive,
+	}
+	newHead, err := store.Put(ctx, &outState)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to store migrated miner state for %s: %w", in.Address, err)
+	}
+	return &StateMigrationResult{
+		NewCodeCID: builtin3.StorageMinerActorCodeID,
+		NewHead:    newHead,
+	}, nil
+}
+
+// migrateSectorInfo migrates a single entry of a miner's Sectors AMT. The v2 and v3 shapes of
+// SectorOnChainInfo are identical field-for-field; this only exists so the copy runs through
+// ParallelArrayMigrate's worker pool instead of serially with the rest of the actor's state.
+func migrateSectorInfo(_ context.Context, _ cbor.IpldStore, _ uint64, value *cbg.Deferred) (*cbg.Deferred, bool, error) {
+	var sectorIn miner2.SectorOnChainInfo
+	if err := sectorIn.UnmarshalCBOR(bytes.NewReader(value.Raw)); err != nil {
+		return nil, false, xerrors.Errorf("failed to unmarshal sector info: %w", err)
+	}
+	sectorOut := miner3.SectorOnChainInfo{
+		SectorNumber:          sectorIn.SectorNumber,
+		SealProof:             sectorIn.SealProof,
+		SealedCID:             sectorIn.SealedCID,
+		DealIDs:               sectorIn.DealIDs,
+		Activation:            sectorIn.Activation,
+		Expiration:            sectorIn.Expiration,
+		DealWeight:            sectorIn.DealWeight,
+		VerifiedDealWeight:    sectorIn.VerifiedDealWeight,
+		InitialPledge:         sectorIn.InitialPledge,
+		ExpectedDayReward:     sectorIn.ExpectedDayReward,
+		ExpectedStoragePledge: sectorIn.ExpectedStoragePledge,
+		ReplacedSectorAge:     sectorIn.ReplacedSectorAge,
+		ReplacedDayReward:     sectorIn.ReplacedDayReward,
+	}
+	var buf bytes.Buffer
+	if err := sectorOut.MarshalCBOR(&buf); err != nil {
+		return nil, false, xerrors.Errorf("failed to marshal sector info: %w", err)
+	}
+	return &cbg.Deferred{Raw: buf.Bytes()}, true, nil
+}
@@ -0,0 +1,221 @@
+package nv9
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/sync/errgroup"
+
+	adt3 "github.com/filecoin-project/specs-actors/v3/actors/util/adt"
+
+	"github.com/filecoin-project/specs-actors/v3/actors/migration"
+)
+
+// MapMigrationFunc migrates a single HAMT entry. Returning a different newKey than the one
+// passed in moves the entry; ok=false drops it from the output map entirely.
+type MapMigrationFunc func(ctx context.Context, store cbor.IpldStore, key string, value *cbg.Deferred) (newKey string, newValue *cbg.Deferred, ok bool, err error)
+
+// ArrayMigrationFunc migrates a single AMT entry. ok=false drops it from the output array.
+type ArrayMigrationFunc func(ctx context.Context, store cbor.IpldStore, key uint64, value *cbg.Deferred) (newValue *cbg.Deferred, ok bool, err error)
+
+type stringKey string
+
+func (k stringKey) Key() string { return string(k) }
+
+// ParallelMapMigrate migrates the entries of a HAMT concurrently, using the same worker/queue
+// design as migration.MigrateStateTree, and rebuilds the output map deterministically (entries
+// are sorted by key before insertion) so the resulting root CID does not depend on the order
+// workers happen to finish in or on the worker count used. It exists because a single actor's
+// HAMT can be gigabytes large, and migrating it on one goroutine serializes the bulk of a mainnet
+// migration's wall-clock time. See ParallelArrayMigrate for the AMT equivalent, which
+// minerMigrator and marketMigrator use (in miner.go and market.go) for their Sectors, Proposals
+// and States collections.
+func ParallelMapMigrate(ctx context.Context, store cbor.IpldStore, root cid.Cid, bitwidth int, cfg migration.Config, fn MapMigrationFunc) (cid.Cid, error) {
+	if cfg.MaxWorkers <= 0 {
+		cfg.MaxWorkers = 1
+	}
+	adtStore := adt3.WrapStore(ctx, store)
+	mapIn, err := adt3.AsMap(adtStore, root, bitwidth)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	type job struct {
+		key   string
+		value *cbg.Deferred
+	}
+	type outcome struct {
+		key   string
+		value *cbg.Deferred
+	}
+
+	grp, ctx := errgroup.WithContext(ctx)
+	jobs := make(chan job, cfg.JobQueueSize)
+	outcomes := make(chan outcome, cfg.ResultQueueSize)
+
+	grp.Go(func() error {
+		defer close(jobs)
+		var v cbg.Deferred
+		return mapIn.ForEach(&v, func(k string) error {
+			raw := make([]byte, len(v.Raw))
+			copy(raw, v.Raw)
+			select {
+			case jobs <- job{key: k, value: &cbg.Deferred{Raw: raw}}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	})
+
+	var workerWg sync.WaitGroup
+	for i := uint(0); i < cfg.MaxWorkers; i++ {
+		workerWg.Add(1)
+		grp.Go(func() error {
+			defer workerWg.Done()
+			for j := range jobs {
+				newKey, newValue, ok, err := fn(ctx, store, j.key, j.value)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				select {
+				case outcomes <- outcome{key: newKey, value: newValue}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	grp.Go(func() error {
+		workerWg.Wait()
+		close(outcomes)
+		return nil
+	})
+
+	var collected []outcome
+	grp.Go(func() error {
+		for o := range outcomes {
+			collected = append(collected, o)
+		}
+		return nil
+	})
+
+	if err := grp.Wait(); err != nil {
+		return cid.Undef, err
+	}
+
+	sort.Slice(collected, func(i, j int) bool { return collected[i].key < collected[j].key })
+
+	mapOut, err := adt3.MakeEmptyMap(adtStore, bitwidth)
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, o := range collected {
+		if err := mapOut.Put(stringKey(o.key), o.value); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return mapOut.Root()
+}
+
+// ParallelArrayMigrate migrates the entries of an AMT concurrently, analogous to
+// ParallelMapMigrate for HAMTs.
+func ParallelArrayMigrate(ctx context.Context, store cbor.IpldStore, root cid.Cid, bitwidth int, cfg migration.Config, fn ArrayMigrationFunc) (cid.Cid, error) {
+	if cfg.MaxWorkers <= 0 {
+		cfg.MaxWorkers = 1
+	}
+	adtStore := adt3.WrapStore(ctx, store)
+	arrIn, err := adt3.AsArray(adtStore, root, bitwidth)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	type job struct {
+		key   uint64
+		value *cbg.Deferred
+	}
+	type outcome struct {
+		key   uint64
+		value *cbg.Deferred
+	}
+
+	grp, ctx := errgroup.WithContext(ctx)
+	jobs := make(chan job, cfg.JobQueueSize)
+	outcomes := make(chan outcome, cfg.ResultQueueSize)
+
+	grp.Go(func() error {
+		defer close(jobs)
+		var v cbg.Deferred
+		return arrIn.ForEach(&v, func(k int64) error {
+			raw := make([]byte, len(v.Raw))
+			copy(raw, v.Raw)
+			select {
+			case jobs <- job{key: uint64(k), value: &cbg.Deferred{Raw: raw}}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	})
+
+	var workerWg sync.WaitGroup
+	for i := uint(0); i < cfg.MaxWorkers; i++ {
+		workerWg.Add(1)
+		grp.Go(func() error {
+			defer workerWg.Done()
+			for j := range jobs {
+				newValue, ok, err := fn(ctx, store, j.key, j.value)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				select {
+				case outcomes <- outcome{key: j.key, value: newValue}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}
+	grp.Go(func() error {
+		workerWg.Wait()
+		close(outcomes)
+		return nil
+	})
+
+	var collected []outcome
+	grp.Go(func() error {
+		for o := range outcomes {
+			collected = append(collected, o)
+		}
+		return nil
+	})
+
+	if err := grp.Wait(); err != nil {
+		return cid.Undef, err
+	}
+
+	sort.Slice(collected, func(i, j int) bool { return collected[i].key < collected[j].key })
+
+	arrOut, err := adt3.MakeEmptyArray(adtStore, bitwidth)
+	if err != nil {
+		return cid.Undef, err
+	}
+	for _, o := range collected {
+		if err := arrOut.Set(o.key, o.value); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return arrOut.Root()
+}
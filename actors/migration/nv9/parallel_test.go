@@ -0,0 +1,68 @@
+package nv9
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"github.com/stretchr/testify/require"
+
+	adt3 "github.com/filecoin-project/specs-actors/v3/actors/util/adt"
+
+	"github.com/filecoin-project/specs-actors/v3/actors/migration"
+)
+
+const testBitwidth = 5
+
+// identityMapFunc and identityArrayFunc pass each entry through unchanged, isolating the
+// determinism guarantee ParallelMapMigrate/ParallelArrayMigrate make (reproducible root regardless
+// of worker count) from whatever a real per-entry transform does.
+func identityMapFunc(_ context.Context, _ cbor.IpldStore, k string, v *cbg.Deferred) (string, *cbg.Deferred, bool, error) {
+	return k, v, true, nil
+}
+
+func identityArrayFunc(_ context.Context, _ cbor.IpldStore, _ uint64, v *cbg.Deferred) (*cbg.Deferred, bool, error) {
+	return v, true, nil
+}
+
+func TestParallelMapMigrateDeterministic(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+	adtStore := adt3.WrapStore(ctx, store)
+
+	m, err := adt3.MakeEmptyMap(adtStore, testBitwidth)
+	require.NoError(t, err)
+	for i := 0; i < 64; i++ {
+		require.NoError(t, m.Put(stringKey(fmt.Sprintf("key-%03d", i)), &cbg.Deferred{Raw: []byte{byte(i)}}))
+	}
+	root, err := m.Root()
+	require.NoError(t, err)
+
+	rootFewWorkers, err := ParallelMapMigrate(ctx, store, root, testBitwidth, migration.Config{MaxWorkers: 1}, identityMapFunc)
+	require.NoError(t, err)
+	rootManyWorkers, err := ParallelMapMigrate(ctx, store, root, testBitwidth, migration.Config{MaxWorkers: 8}, identityMapFunc)
+	require.NoError(t, err)
+	require.Equal(t, rootFewWorkers, rootManyWorkers, "ParallelMapMigrate output root must not depend on worker count")
+}
+
+func TestParallelArrayMigrateDeterministic(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+	adtStore := adt3.WrapStore(ctx, store)
+
+	arr, err := adt3.MakeEmptyArray(adtStore, testBitwidth)
+	require.NoError(t, err)
+	for i := uint64(0); i < 64; i++ {
+		require.NoError(t, arr.Set(i, &cbg.Deferred{Raw: []byte{byte(i)}}))
+	}
+	root, err := arr.Root()
+	require.NoError(t, err)
+
+	rootFewWorkers, err := ParallelArrayMigrate(ctx, store, root, testBitwidth, migration.Config{MaxWorkers: 1}, identityArrayFunc)
+	require.NoError(t, err)
+	rootManyWorkers, err := ParallelArrayMigrate(ctx, store, root, testBitwidth, migration.Config{MaxWorkers: 8}, identityArrayFunc)
+	require.NoError(t, err)
+	require.Equal(t, rootFewWorkers, rootManyWorkers, "ParallelArrayMigrate output root must not depend on worker count")
+}
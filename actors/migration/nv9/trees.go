@@ -0,0 +1,47 @@
+package nv9
+
+import (
+	address "github.com/filecoin-project/go-address"
+	cid "github.com/ipfs/go-cid"
+
+	states2 "github.com/filecoin-project/specs-actors/v2/actors/states"
+	states3 "github.com/filecoin-project/specs-actors/v3/actors/states"
+
+	"github.com/filecoin-project/specs-actors/v3/actors/migration"
+)
+
+// inputTree adapts a v2 state tree to the version-agnostic migration.InputTree interface expected
+// by the shared migration driver.
+type inputTree struct {
+	*states2.Tree
+}
+
+func (t inputTree) ForEach(fn func(addr address.Address, actorIn *migration.Actor) error) error {
+	return t.Tree.ForEach(func(addr address.Address, actorIn *states2.Actor) error {
+		return fn(addr, &migration.Actor{
+			Code:       actorIn.Code,
+			Head:       actorIn.Head,
+			CallSeqNum: actorIn.CallSeqNum,
+			Balance:    actorIn.Balance,
+		})
+	})
+}
+
+// outputTree adapts a v3 state tree to the version-agnostic migration.OutputTree interface expected
+// by the shared migration driver.
+type outputTree struct {
+	*states3.Tree
+}
+
+func (t outputTree) SetActor(addr address.Address, actorOut *migration.Actor) error {
+	return t.Tree.SetActor(addr, &states3.Actor{
+		Code:       actorOut.Code,
+		Head:       actorOut.Head,
+		CallSeqNum: actorOut.CallSeqNum,
+		Balance:    actorOut.Balance,
+	})
+}
+
+func (t outputTree) Flush() (cid.Cid, error) {
+	return t.Tree.Flush()
+}
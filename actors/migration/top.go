@@ -0,0 +1,565 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	address "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/rt"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+// MigrationCache is a persistent store of migration results, keyed by an opaque string the caller
+// derives from whatever it is caching. It lets a resumed or repeated migration run (e.g. Lotus's
+// pre-migration dry run followed by the real migration at the upgrade epoch) skip work it has
+// already done.
+type MigrationCache interface {
+	Load(key string) (c cid.Cid, found bool, err error)
+	Store(key string, c cid.Cid) error
+}
+
+// actorCacheKey derives the MigrationCache key for a single actor's migration result. It is keyed
+// on everything MigrateState's output can depend on, so a cache entry is reusable exactly when
+// re-running MigrateState on the same input would produce the same NewHead.
+func actorCacheKey(oldCodeCID, oldHead cid.Cid, priorEpoch abi.ChainEpoch) string {
+	return fmt.Sprintf("migration-%s-%s-%d", oldCodeCID, oldHead, priorEpoch)
+}
+
+// Config parameterizes a state tree migration.
+type Config struct {
+	// Number of migration worker goroutines to run.
+	// More workers enables higher CPU utilization doing migration computations (including state encoding)
+	MaxWorkers uint
+	// Capacity of the queue of jobs available to workers (zero for unbuffered).
+	// A queue length of hundreds to thousands improves throughput at the cost of memory.
+	JobQueueSize uint
+	// Capacity of the queue receiving migration results from workers, for persisting (zero for unbuffered).
+	// A queue length of tens to hundreds improves throughput at the cost of memory.
+	ResultQueueSize uint
+	// Time between progress logs to emit.
+	// Zero (the default) results in no progress logs.
+	ProgressLogPeriod time.Duration
+	// Cache of per-actor migration results, shared across migration attempts (e.g. a
+	// pre-migration dry run and the real migration it precedes). Optional.
+	CachedMigration MigrationCache
+	// Time between flushing a partial output tree root and a bitmap of completed addresses to
+	// CachedMigration, so an interrupted run can resume from the last checkpoint rather than
+	// starting over. Zero (the default) disables checkpointing. Has no effect if
+	// CachedMigration is nil.
+	CheckpointPeriod time.Duration
+	// When set, every block written to the store while migrating the state tree (whether or not
+	// the input store already held it) is streamed into a CARv2 file written here, rooted at the
+	// migrated state tree root, once the migration completes successfully. This lets an operator
+	// ship and independently replay the migration's output without the full input state tree.
+	ExportCAR io.Writer
+	// Pre-migration hooks, keyed by the prior-version code CID they apply to, run once per actor
+	// of that code CID before the parallel per-actor pass begins. They exist to seed the
+	// MigrationContext bus (e.g. with per-miner totals) for a later Deferred() migrator to
+	// consume; they do not themselves produce migrated state.
+	PreMigrations map[cid.Cid]PreMigration
+	// Order in which the code CIDs of Deferred() migrations are run, once the parallel pass has
+	// completed. Migrations for a code CID not listed here run after every listed one, in the
+	// order they were encountered. Only meaningful when more than one deferred migration depends
+	// on another's published values (e.g. verifreg consuming totals market accumulated).
+	DeferredMigrationOrder []cid.Cid
+	// Receives structured progress events for this run, in addition to (not instead of) Logger.
+	// Optional; nil disables reporting. See ProgressReporter and PrometheusReporter.
+	Progress ProgressReporter
+}
+
+// Actor is a version-agnostic view of an actor's state tree entry, used to decouple the migration
+// driver from the concrete states.Actor type of any particular network version.
+type Actor struct {
+	Code       cid.Cid
+	Head       cid.Cid
+	CallSeqNum uint64
+	Balance    abi.TokenAmount
+}
+
+// InputTree is the minimal view of a prior-version state tree the driver needs: the ability to
+// visit every actor in it.
+type InputTree interface {
+	ForEach(fn func(addr address.Address, actorIn *Actor) error) error
+}
+
+// OutputTree is the minimal view of the new state tree the driver needs: the ability to record
+// migrated actors and flush the result to a new root.
+type OutputTree interface {
+	SetActor(addr address.Address, actorOut *Actor) error
+	Flush() (cid.Cid, error)
+}
+
+// ActorMigrationInput is the input to a single actor's state migration.
+type ActorMigrationInput struct {
+	Address    address.Address // actor's address
+	Balance    abi.TokenAmount // actor's balance
+	Head       cid.Cid         // actor's state head CID
+	PriorEpoch abi.ChainEpoch  // epoch of last state transition prior to migration
+}
+
+// ActorMigrationResult is the result of a single actor's state migration.
+type ActorMigrationResult struct {
+	NewCodeCID cid.Cid
+	NewHead    cid.Cid
+}
+
+// ActorMigration migrates a single actor's state from one version to the next.
+// A caller-supplied map[cid.Cid]ActorMigration, keyed by the actor's prior-version code CID,
+// drives MigrateStateTree: this package has no knowledge of any particular pair of versions.
+type ActorMigration interface {
+	// Loads an actor's state from an input store and writes new state to an output store.
+	// Returns the new state head CID. migCtx is the publish/subscribe bus shared by every
+	// migrator in this run; most migrators ignore it.
+	MigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput, migCtx *MigrationContext) (result *ActorMigrationResult, err error)
+	// The code CID of the actor after migration.
+	MigratedCodeCID() cid.Cid
+	// Deferred migrations are skipped during the parallel pass over the state tree and instead
+	// run afterwards, once that pass has completed (see Config.DeferredMigrationOrder). This is
+	// for migrators that need to consume state accumulated through the migration of other actors
+	// (e.g. a market migration that needs every miner's deal state migrated first).
+	Deferred() bool
+}
+
+// PreMigration runs once, serially, for every actor of its registered code CID before the
+// parallel per-actor migration pass begins.
+type PreMigration interface {
+	PreMigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput, migCtx *MigrationContext) error
+}
+
+type Logger interface {
+	// This is the same logging interface provided by the Runtime.
+	Log(level rt.LogLevel, msg string, args ...interface{})
+}
+
+// UnknownActorCodeError is returned by MigrateStateTree when the input state tree contains actors
+// whose code CID has no registered migration.
+type UnknownActorCodeError struct {
+	Codes []cid.Cid
+}
+
+func (e *UnknownActorCodeError) Error() string {
+	return fmt.Sprintf("no migration registered for code CIDs: %v", e.Codes)
+}
+
+// MigrateStateTree migrates every actor in actorsIn to actorsOut, using the migrations supplied,
+// and returns the flushed root of actorsOut. It implements the worker/queue plumbing shared by
+// every network version upgrade: callers provide only the per-actor migrations and the concrete
+// input/output state trees.
+func MigrateStateTree(ctx context.Context, store cbor.IpldStore, migrations map[cid.Cid]ActorMigration, actorsIn InputTree, actorsOut OutputTree, priorEpoch abi.ChainEpoch, cfg Config, log Logger) (cid.Cid, error) {
+	if cfg.MaxWorkers <= 0 {
+		return cid.Undef, xerrors.Errorf("invalid migration config with %d workers", cfg.MaxWorkers)
+	}
+
+	startTime := time.Now()
+
+	// Resume from a prior checkpoint, if CachedMigration holds one for this priorEpoch.
+	checkpoint, err := loadCheckpoint(ctx, store, cfg, priorEpoch)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	// Record every block newly written during this migration so it can be exported as a CAR
+	// once the migration completes. Wrapping is idempotent, so a caller that already wrapped
+	// store (e.g. to construct actorsOut against the recording store too) is not double-wrapped.
+	store = WrapExportStore(store, cfg)
+
+	migCtx := NewMigrationContext()
+
+	// Phase 1: run pre-migration hooks, serially, over every actor whose code CID has one
+	// registered. These may publish values on migCtx for a Deferred() migration to consume later.
+	if len(cfg.PreMigrations) > 0 {
+		log.Log(rt.INFO, "Running pre-migration hooks")
+		preMigrationStart := time.Now()
+		if err := actorsIn.ForEach(func(addr address.Address, actorIn *Actor) error {
+			pre, ok := cfg.PreMigrations[actorIn.Code]
+			if !ok {
+				return nil
+			}
+			return pre.PreMigrateState(ctx, store, ActorMigrationInput{
+				Address:    addr,
+				Balance:    actorIn.Balance,
+				Head:       actorIn.Head,
+				PriorEpoch: priorEpoch,
+			}, migCtx)
+		}); err != nil {
+			return cid.Undef, xerrors.Errorf("pre-migration hook failed: %w", err)
+		}
+		if cfg.Progress != nil {
+			cfg.Progress.PhaseCompleted("pre-migration", time.Since(preMigrationStart))
+		}
+	}
+
+	// Setup synchronization
+	grp, ctx := errgroup.WithContext(ctx)
+	// Input and output queues for workers.
+	inputCh := make(chan *migrationInput, cfg.JobQueueSize)
+	resultCh := make(chan *migrationResult, cfg.ResultQueueSize)
+	// Atomically-modified counters for logging progress
+	var jobCount uint32
+	var doneCount uint32
+	// Addresses completed so far, used to checkpoint progress for resuming an interrupted run.
+	// Protected by completedLk since the job creator reads it while the result writer updates it.
+	var completedLk sync.Mutex
+	completed := checkpoint.bitmap
+
+	// Deferred migrations, collected while iterating the input tree and run explicitly afterwards.
+	var deferred []*migrationInput
+
+	parallelStart := time.Now()
+
+	// Iterate all actors in old state root to generate migration inputs for each non-deferred actor.
+	grp.Go(func() error {
+		defer close(inputCh)
+		log.Log(rt.INFO, "Creating migration jobs for state tree")
+		var unknownCodes []cid.Cid
+		index := 0
+		if err := actorsIn.ForEach(func(addr address.Address, actorIn *Actor) error {
+			defer func() { index++ }()
+			migrator, ok := migrations[actorIn.Code]
+			if !ok {
+				unknownCodes = append(unknownCodes, actorIn.Code)
+				return nil
+			}
+			nextInput := &migrationInput{
+				Index:          index,
+				Address:        addr,
+				Actor:          *actorIn, // Must take a copy, the pointer is not stable.
+				ActorMigration: migrator,
+			}
+			if migrator.Deferred() {
+				deferred = append(deferred, nextInput)
+				return nil
+			}
+			completedLk.Lock()
+			alreadyDone := completed.Has(index)
+			completedLk.Unlock()
+			if alreadyDone {
+				// Already migrated and written to actorsOut by a prior, interrupted run.
+				atomic.AddUint32(&jobCount, 1)
+				atomic.AddUint32(&doneCount, 1)
+				return nil
+			}
+			select {
+			case inputCh <- nextInput:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			atomic.AddUint32(&jobCount, 1)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(unknownCodes) > 0 {
+			return &UnknownActorCodeError{Codes: unknownCodes}
+		}
+		log.Log(rt.INFO, "Done creating %d migration jobs after %v", jobCount, time.Since(startTime))
+		if cfg.Progress != nil {
+			cfg.Progress.JobsCreated(int(jobCount))
+		}
+		return nil
+	})
+
+	// Worker threads run migrations on inputs.
+	var workerWg sync.WaitGroup
+	for i := uint(0); i < cfg.MaxWorkers; i++ {
+		workerWg.Add(1)
+		workerId := i
+		grp.Go(func() error {
+			defer workerWg.Done()
+			for input := range inputCh {
+				result, err := runMigrationCached(ctx, store, cfg, input, priorEpoch, migCtx)
+				if err != nil {
+					return err
+				}
+				select {
+				case resultCh <- result:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				atomic.AddUint32(&doneCount, 1)
+			}
+			log.Log(rt.DEBUG, "Worker %d done", workerId)
+			return nil
+		})
+	}
+	log.Log(rt.INFO, "Started %d workers", cfg.MaxWorkers)
+
+	// Monitor the job queue. This non-critical goroutine is outside the errgroup and exits when
+	// workersFinished is closed, or the context done.
+	workersFinished := make(chan struct{}) // Closed when waitgroup is emptied.
+
+	// Periodically ask the result writer (below) to checkpoint a partial output root and the
+	// completed-address bitmap, so an interrupted run can resume rather than redo its work. The
+	// checkpoint itself is taken by the result writer goroutine, not this one: actorsOut is a
+	// *states3.Tree (or equivalent), which is not safe for concurrent read+mutate, and the result
+	// writer is the only goroutine that calls SetActor on it.
+	var checkpointCh chan struct{}
+	if cfg.CachedMigration != nil && cfg.CheckpointPeriod > 0 {
+		checkpointCh = make(chan struct{}, 1)
+		go func() {
+			ticker := time.NewTicker(cfg.CheckpointPeriod)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					select {
+					case checkpointCh <- struct{}{}:
+					default: // A checkpoint request is already pending; no need to queue another.
+					}
+				case <-workersFinished:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if cfg.ProgressLogPeriod > 0 {
+		go func() {
+			defer log.Log(rt.DEBUG, "Job queue monitor done")
+			for {
+				select {
+				case <-time.After(cfg.ProgressLogPeriod):
+					jobsNow := jobCount // Snapshot values to avoid incorrect-looking arithmetic if they change.
+					doneNow := doneCount
+					pendingNow := jobsNow - doneNow
+					elapsed := time.Since(startTime)
+					rate := float64(doneNow) / elapsed.Seconds()
+					log.Log(rt.INFO, "%d jobs created, %d done, %d pending after %v (%.0f/s)",
+						jobsNow, doneNow, pendingNow, elapsed, rate)
+					if cfg.Progress != nil {
+						cfg.Progress.QueueDepth(int(pendingNow))
+					}
+				case <-workersFinished:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Close result channel when workers are done sending to it.
+	grp.Go(func() error {
+		workerWg.Wait()
+		close(resultCh)
+		close(workersFinished)
+		log.Log(rt.INFO, "All workers done after %v", time.Since(startTime))
+		return nil
+	})
+
+	// Insert migrated records in output state tree. This is the only goroutine that touches
+	// actorsOut while the parallel pass is running, including for checkpointing (see
+	// checkpointCh above), since it is not safe for concurrent access.
+	grp.Go(func() error {
+		log.Log(rt.INFO, "Result writer started")
+		resultCount := 0
+		for {
+			select {
+			case result, ok := <-resultCh:
+				if !ok {
+					log.Log(rt.INFO, "Result writer wrote %d results to state tree after %v", resultCount, time.Since(startTime))
+					return nil
+				}
+				if err := actorsOut.SetActor(result.Address, &result.Actor); err != nil {
+					return err
+				}
+				completedLk.Lock()
+				completed.Set(result.Index)
+				completedLk.Unlock()
+				resultCount++
+			case <-checkpointCh:
+				completedLk.Lock()
+				snapshot := completed.Clone()
+				completedLk.Unlock()
+				if err := storeCheckpoint(ctx, store, cfg, priorEpoch, actorsOut, snapshot); err != nil {
+					log.Log(rt.WARN, "Failed to store migration checkpoint: %s", err)
+				}
+			}
+		}
+	})
+
+	if err := grp.Wait(); err != nil {
+		return cid.Undef, err
+	}
+	if cfg.Progress != nil {
+		cfg.Progress.PhaseCompleted("parallel", time.Since(parallelStart))
+	}
+
+	// Run deferred migrations explicitly now that every other actor has been migrated. These may
+	// depend on values accumulated through migration of other actors, so they run in
+	// Config.DeferredMigrationOrder (falling back to encounter order) on a single goroutine
+	// rather than racing through the worker pool.
+	if len(deferred) > 0 {
+		sortDeferred(deferred, cfg.DeferredMigrationOrder)
+		log.Log(rt.INFO, "Running %d deferred migrations", len(deferred))
+		if cfg.Progress != nil {
+			cfg.Progress.DeferredMigrationStarted(len(deferred))
+		}
+		deferredStart := time.Now()
+		for _, input := range deferred {
+			result, err := runMigrationCached(ctx, store, cfg, input, priorEpoch, migCtx)
+			if err != nil {
+				return cid.Undef, err
+			}
+			if err := actorsOut.SetActor(result.Address, &result.Actor); err != nil {
+				return cid.Undef, err
+			}
+			doneCount++
+		}
+		if cfg.Progress != nil {
+			cfg.Progress.PhaseCompleted("deferred", time.Since(deferredStart))
+		}
+	}
+
+	elapsed := time.Since(startTime)
+	rate := float64(doneCount) / elapsed.Seconds()
+	log.Log(rt.INFO, "All %d done after %v (%.0f/s). Flushing state tree root.", doneCount, elapsed, rate)
+	root, err := actorsOut.Flush()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if cfg.ExportCAR != nil {
+		rs, ok := store.(recordingStore)
+		if !ok {
+			return cid.Undef, xerrors.Errorf("internal error: store not wrapped by WrapExportStore despite Config.ExportCAR being set")
+		}
+		log.Log(rt.INFO, "Exporting migrated blocks as a CAR rooted at %s", root)
+		if err := writeCAR(cfg.ExportCAR, root, rs.recorder); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return root, nil
+}
+
+type migrationInput struct {
+	Index int // Position in the (deterministic) iteration order of actorsIn, for checkpointing.
+	address.Address
+	Actor
+	ActorMigration
+}
+type migrationResult struct {
+	Index int
+	address.Address
+	Actor
+}
+
+// runMigrationCached runs input's migration, consulting and populating cache (if non-nil) keyed
+// on the actor's old code CID, old head and priorEpoch, so that a repeat run over the same input
+// (e.g. Lotus re-running the same migration at the real upgrade epoch after a pre-migration dry
+// run) can skip MigrateState entirely.
+func runMigrationCached(ctx context.Context, store cbor.IpldStore, cfg Config, input *migrationInput, priorEpoch abi.ChainEpoch, migCtx *MigrationContext) (*migrationResult, error) {
+	actorIn := input.Actor
+	addr := input.Address
+	start := time.Now()
+
+	if cfg.CachedMigration != nil {
+		key := actorCacheKey(actorIn.Code, actorIn.Head, priorEpoch)
+		if newHead, found, err := cfg.CachedMigration.Load(key); err != nil {
+			return nil, xerrors.Errorf("failed to load cached migration for addr %s: %w", addr, err)
+		} else if found {
+			if cfg.Progress != nil {
+				cfg.Progress.ActorMigrated(ActorMigratedEvent{
+					Addr:     addr,
+					Code:     actorIn.Code,
+					Duration: time.Since(start),
+					CacheHit: true,
+				})
+			}
+			return &migrationResult{
+				input.Index,
+				addr,
+				Actor{
+					Code:       input.MigratedCodeCID(),
+					Head:       newHead,
+					CallSeqNum: actorIn.CallSeqNum,
+					Balance:    actorIn.Balance,
+				},
+			}, nil
+		}
+	}
+
+	result, bytesRead, bytesWritten, err := runMigration(ctx, store, input, priorEpoch, migCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CachedMigration != nil {
+		key := actorCacheKey(actorIn.Code, actorIn.Head, priorEpoch)
+		if err := cfg.CachedMigration.Store(key, result.Head); err != nil {
+			return nil, xerrors.Errorf("failed to store cached migration for addr %s: %w", addr, err)
+		}
+	}
+	if cfg.Progress != nil {
+		cfg.Progress.ActorMigrated(ActorMigratedEvent{
+			Addr:         addr,
+			Code:         actorIn.Code,
+			Duration:     time.Since(start),
+			BytesRead:    bytesRead,
+			BytesWritten: bytesWritten,
+		})
+	}
+	return result, nil
+}
+
+func runMigration(ctx context.Context, store cbor.IpldStore, input *migrationInput, priorEpoch abi.ChainEpoch, migCtx *MigrationContext) (result *migrationResult, bytesRead int64, bytesWritten int64, err error) {
+	actorIn := input.Actor
+	addr := input.Address
+	counting := &countingStore{IpldStore: store}
+	out, err := input.MigrateState(ctx, counting, ActorMigrationInput{
+		Address:    addr,
+		Balance:    actorIn.Balance,
+		Head:       actorIn.Head,
+		PriorEpoch: priorEpoch,
+	}, migCtx)
+	if err != nil {
+		return nil, 0, 0, xerrors.Errorf("state migration failed for code %s, addr %s: %w", actorIn.Code, addr, err)
+	}
+
+	// Set up new actor record with the migrated state.
+	return &migrationResult{
+		input.Index,
+		addr, // Unchanged
+		Actor{
+			Code:       out.NewCodeCID,
+			Head:       out.NewHead,
+			CallSeqNum: actorIn.CallSeqNum, // Unchanged
+			Balance:    actorIn.Balance,    // Unchanged
+		},
+	}, atomic.LoadInt64(&counting.read), atomic.LoadInt64(&counting.written), nil
+}
+
+// sortDeferred stably reorders deferred so migrations for code CIDs earlier in order run first;
+// migrations for a code CID absent from order keep their relative (encounter) position after
+// every listed one.
+func sortDeferred(deferred []*migrationInput, order []cid.Cid) {
+	if len(order) == 0 {
+		return
+	}
+	rank := make(map[cid.Cid]int, len(order))
+	for i, c := range order {
+		rank[c] = i
+	}
+	sort.SliceStable(deferred, func(i, j int) bool {
+		ri, iok := rank[deferred[i].Code]
+		rj, jok := rank[deferred[j].Code]
+		if !iok {
+			ri = len(order)
+		}
+		if !jok {
+			rj = len(order)
+		}
+		return ri < rj
+	})
+}
@@ -0,0 +1,335 @@
+package migration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	address "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	big "github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/rt"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Log(rt.LogLevel, string, ...interface{}) {}
+
+type fakeActorEntry struct {
+	addr address.Address
+	code cid.Cid
+	head cid.Cid
+}
+
+type fakeInputTree struct {
+	actors []fakeActorEntry
+}
+
+func (t fakeInputTree) ForEach(fn func(addr address.Address, actorIn *Actor) error) error {
+	for _, a := range t.actors {
+		actorIn := Actor{Code: a.code, Head: a.head, Balance: big.Zero()}
+		if err := fn(a.addr, &actorIn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeOutputTree is a minimal OutputTree whose Flush is deterministic in the set of actors
+// recorded, independent of the order SetActor was called in, so it can stand in for a real
+// states.Tree in tests that care about reproducible roots (e.g. checkpoint resume).
+type fakeOutputTree struct {
+	store cbor.IpldStore
+	set   map[address.Address]Actor
+}
+
+func newFakeOutputTree(store cbor.IpldStore) *fakeOutputTree {
+	return &fakeOutputTree{store: store, set: map[address.Address]Actor{}}
+}
+
+func (t *fakeOutputTree) SetActor(addr address.Address, actorOut *Actor) error {
+	t.set[addr] = *actorOut
+	return nil
+}
+
+func (t *fakeOutputTree) Flush() (cid.Cid, error) {
+	addrs := make([]string, 0, len(t.set))
+	for addr := range t.set {
+		addrs = append(addrs, addr.String())
+	}
+	sort.Strings(addrs)
+	entries := make([]cid.Cid, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := address.NewFromString(s)
+		if err != nil {
+			return cid.Undef, err
+		}
+		entries = append(entries, t.set[addr].Head)
+	}
+	return t.store.Put(context.Background(), entries)
+}
+
+type memMigrationCache struct {
+	entries map[string]cid.Cid
+}
+
+func newMemMigrationCache() *memMigrationCache {
+	return &memMigrationCache{entries: map[string]cid.Cid{}}
+}
+
+func (c *memMigrationCache) Load(key string) (cid.Cid, bool, error) {
+	v, ok := c.entries[key]
+	return v, ok, nil
+}
+
+func (c *memMigrationCache) Store(key string, v cid.Cid) error {
+	c.entries[key] = v
+	return nil
+}
+
+// countingMigration is an ActorMigration that records how many times MigrateState actually ran,
+// to distinguish real work from a Config.CachedMigration hit.
+type countingMigration struct {
+	calls      *int32
+	newCodeCID cid.Cid
+}
+
+func (m countingMigration) MigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput, _ *MigrationContext) (*ActorMigrationResult, error) {
+	atomic.AddInt32(m.calls, 1)
+	newHead, err := store.Put(ctx, input.Head.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &ActorMigrationResult{NewCodeCID: m.newCodeCID, NewHead: newHead}, nil
+}
+
+func (m countingMigration) MigratedCodeCID() cid.Cid { return m.newCodeCID }
+func (m countingMigration) Deferred() bool           { return false }
+
+func TestMigrateStateTreeUnknownActorCode(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+
+	registeredCode := mustCborCid(t, store, "registered")
+	unknownCode := mustCborCid(t, store, "unknown")
+	addr := newTestAddress(t, 100)
+
+	actorsIn := fakeInputTree{actors: []fakeActorEntry{
+		{addr: addr, code: unknownCode, head: registeredCode},
+	}}
+	var calls int32
+	migrations := map[cid.Cid]ActorMigration{
+		registeredCode: countingMigration{calls: &calls, newCodeCID: registeredCode},
+	}
+
+	_, err := MigrateStateTree(ctx, store, migrations, actorsIn, newFakeOutputTree(store), abi.ChainEpoch(0), Config{MaxWorkers: 1}, noopLogger{})
+	require.Error(t, err)
+	var unknownErr *UnknownActorCodeError
+	require.ErrorAs(t, err, &unknownErr)
+	require.Equal(t, []cid.Cid{unknownCode}, unknownErr.Codes)
+}
+
+// TestMigrateStateTreeCachedMigrationSkipsRerun exercises the Lotus pre-migration pattern: the
+// same migration run twice against the same CachedMigration should only invoke MigrateState once
+// and must produce the same output root both times.
+func TestMigrateStateTreeCachedMigrationSkipsRerun(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+
+	oldCode := mustCborCid(t, store, "old-code")
+	newCode := mustCborCid(t, store, "new-code")
+	head := mustCborCid(t, store, "head")
+	addr := newTestAddress(t, 101)
+
+	actorsIn := fakeInputTree{actors: []fakeActorEntry{{addr: addr, code: oldCode, head: head}}}
+	var calls int32
+	migrations := map[cid.Cid]ActorMigration{
+		oldCode: countingMigration{calls: &calls, newCodeCID: newCode},
+	}
+	cache := newMemMigrationCache()
+	cfg := Config{MaxWorkers: 1, CachedMigration: cache}
+
+	root1, err := MigrateStateTree(ctx, store, migrations, actorsIn, newFakeOutputTree(store), abi.ChainEpoch(0), cfg, noopLogger{})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	root2, err := MigrateStateTree(ctx, store, migrations, actorsIn, newFakeOutputTree(store), abi.ChainEpoch(0), cfg, noopLogger{})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls), "second run should be served entirely from the cache")
+	require.Equal(t, root1, root2, "cached and live migrations must produce the same root")
+}
+
+// orderedMigration is a Deferred ActorMigration that appends its own (prior-version) code CID to
+// a shared, test-owned slice when run, so a test can assert the order Config.DeferredMigrationOrder
+// actually produced. Safe to use without synchronization: deferred migrations run one at a time, on
+// a single goroutine, after the parallel pass has already completed.
+type orderedMigration struct {
+	ownCode    cid.Cid
+	newCodeCID cid.Cid
+	order      *[]cid.Cid
+}
+
+func (m orderedMigration) MigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput, _ *MigrationContext) (*ActorMigrationResult, error) {
+	*m.order = append(*m.order, m.ownCode)
+	newHead, err := store.Put(ctx, input.Head.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &ActorMigrationResult{NewCodeCID: m.newCodeCID, NewHead: newHead}, nil
+}
+
+func (m orderedMigration) MigratedCodeCID() cid.Cid { return m.newCodeCID }
+func (m orderedMigration) Deferred() bool           { return true }
+
+func TestMigrateStateTreeDeferredMigrationOrder(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+
+	codeA := mustCborCid(t, store, "code-a")
+	codeB := mustCborCid(t, store, "code-b")
+	codeC := mustCborCid(t, store, "code-c")
+	newCode := mustCborCid(t, store, "new-code-ordered")
+	head := mustCborCid(t, store, "head-ordered")
+
+	actorsIn := fakeInputTree{actors: []fakeActorEntry{
+		{addr: newTestAddress(t, 401), code: codeA, head: head},
+		{addr: newTestAddress(t, 402), code: codeB, head: head},
+		{addr: newTestAddress(t, 403), code: codeC, head: head},
+	}}
+
+	var order []cid.Cid
+	migrations := map[cid.Cid]ActorMigration{
+		codeA: orderedMigration{ownCode: codeA, newCodeCID: newCode, order: &order},
+		codeB: orderedMigration{ownCode: codeB, newCodeCID: newCode, order: &order},
+		codeC: orderedMigration{ownCode: codeC, newCodeCID: newCode, order: &order},
+	}
+	cfg := Config{MaxWorkers: 1, DeferredMigrationOrder: []cid.Cid{codeC, codeA, codeB}}
+
+	_, err := MigrateStateTree(ctx, store, migrations, actorsIn, newFakeOutputTree(store), abi.ChainEpoch(0), cfg, noopLogger{})
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{codeC, codeA, codeB}, order, "deferred migrations must run in Config.DeferredMigrationOrder")
+}
+
+const testPreMigrationTopic = "test-pre-migration-topic"
+
+// publishingPreMigration publishes the actor's own head under its address, so a later Deferred()
+// migration can prove the hook actually ran, and ran before the deferred pass, by subscribing to it.
+type publishingPreMigration struct{}
+
+func (publishingPreMigration) PreMigrateState(_ context.Context, _ cbor.IpldStore, input ActorMigrationInput, migCtx *MigrationContext) error {
+	migCtx.Publish(testPreMigrationTopic, input.Address, input.Head)
+	return nil
+}
+
+// subscribingMigration is Deferred and fails unless it finds the value publishingPreMigration
+// published for its own address.
+type subscribingMigration struct {
+	newCodeCID cid.Cid
+}
+
+func (m subscribingMigration) MigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput, migCtx *MigrationContext) (*ActorMigrationResult, error) {
+	value, found := migCtx.Subscribe(testPreMigrationTopic, input.Address)
+	if !found {
+		return nil, xerrors.New("expected pre-migration hook to have published a value for this address")
+	}
+	if value.(cid.Cid) != input.Head {
+		return nil, xerrors.New("pre-migration published value does not match actor head")
+	}
+	newHead, err := store.Put(ctx, input.Head.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &ActorMigrationResult{NewCodeCID: m.newCodeCID, NewHead: newHead}, nil
+}
+
+func (m subscribingMigration) MigratedCodeCID() cid.Cid { return m.newCodeCID }
+func (m subscribingMigration) Deferred() bool           { return true }
+
+func TestMigrateStateTreePreMigrationHookRunsBeforeDeferred(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+
+	oldCode := mustCborCid(t, store, "pre-migration-code")
+	newCode := mustCborCid(t, store, "pre-migration-new-code")
+	head := mustCborCid(t, store, "pre-migration-head")
+	addr := newTestAddress(t, 500)
+
+	actorsIn := fakeInputTree{actors: []fakeActorEntry{{addr: addr, code: oldCode, head: head}}}
+	migrations := map[cid.Cid]ActorMigration{
+		oldCode: subscribingMigration{newCodeCID: newCode},
+	}
+	cfg := Config{
+		MaxWorkers:    1,
+		PreMigrations: map[cid.Cid]PreMigration{oldCode: publishingPreMigration{}},
+	}
+
+	_, err := MigrateStateTree(ctx, store, migrations, actorsIn, newFakeOutputTree(store), abi.ChainEpoch(0), cfg, noopLogger{})
+	require.NoError(t, err)
+}
+
+// TestMigrateStateTreeExportCAR is an end-to-end check that Config.ExportCAR captures both a
+// migrated actor's new state (written by an ActorMigration) and the output tree's own internal
+// nodes (written by its Flush), and that the resulting CAR is rooted at the migration's own result.
+func TestMigrateStateTreeExportCAR(t *testing.T) {
+	ctx := context.Background()
+	store := cbor.NewMemCborStore()
+
+	oldCode := mustCborCid(t, store, "old-code-car")
+	newCode := mustCborCid(t, store, "new-code-car")
+	head := mustCborCid(t, store, "head-car")
+	addr := newTestAddress(t, 600)
+
+	actorsIn := fakeInputTree{actors: []fakeActorEntry{{addr: addr, code: oldCode, head: head}}}
+	var calls int32
+	migrations := map[cid.Cid]ActorMigration{
+		oldCode: countingMigration{calls: &calls, newCodeCID: newCode},
+	}
+
+	var car bytes.Buffer
+	cfg := Config{MaxWorkers: 1, ExportCAR: &car}
+
+	// Wrap before constructing the output tree, as nv9 does: actorsOut.Flush() writes blocks of
+	// its own, including the block for the declared root, and those must land in the same
+	// recorder MigrateStateTree wraps internally (WrapExportStore is idempotent).
+	wrappedStore := WrapExportStore(store, cfg)
+	outTree := newFakeOutputTree(wrappedStore)
+
+	root, err := MigrateStateTree(ctx, wrappedStore, migrations, actorsIn, outTree, abi.ChainEpoch(0), cfg, noopLogger{})
+	require.NoError(t, err)
+
+	reader, err := carv2.NewBlockReader(bytes.NewReader(car.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{root}, reader.Roots)
+
+	seen := map[cid.Cid]bool{}
+	for {
+		blk, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		seen[blk.Cid()] = true
+	}
+	require.True(t, seen[root], "exported CAR must contain the block for the migrated tree's own root")
+}
+
+func mustCborCid(t *testing.T, store cbor.IpldStore, s string) cid.Cid {
+	c, err := store.Put(context.Background(), s)
+	require.NoError(t, err)
+	return c
+}
+
+func newTestAddress(t *testing.T, id uint64) address.Address {
+	addr, err := address.NewIDAddress(id)
+	require.NoError(t, err)
+	return addr
+}